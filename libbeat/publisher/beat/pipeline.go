@@ -0,0 +1,54 @@
+package beat
+
+import "time"
+
+// Event is the unit of data flowing through the publisher pipeline, from
+// an input's client.Publish call through to an output and back out as an
+// ACK.
+type Event struct {
+	Timestamp time.Time
+	Meta      EventMeta
+}
+
+// EventMeta is the bookkeeping an input attaches to an event at
+// client.Publish time, so an ACKMeta consumer (e.g. a registrar) can
+// persist per-input progress without retaining the event payload.
+type EventMeta struct {
+	// InputID identifies the input that produced the event, so progress
+	// from concurrently-publishing inputs can be tracked independently.
+	InputID string
+
+	// Source identifies where within the input the event came from, e.g.
+	// a file path.
+	Source string
+
+	// Offset is the input-defined offset or sequence number of the event,
+	// used to resume from the right position after a restart.
+	Offset int64
+
+	Timestamp time.Time
+}
+
+// PipelineACKHandler configures how a client observes ACKs for the events
+// it publishes through the pipeline. At most one of the callbacks may be
+// set.
+type PipelineACKHandler struct {
+	// ACKCount is called with the total number of events ACKed, including
+	// events dropped by the pipeline.
+	ACKCount func(int)
+
+	// ACKEvents is called with every ACKed event, including dropped ones.
+	ACKEvents func([]Event)
+
+	// ACKLastEvents is called with the last event of each client
+	// contribution collected into an ACKed batch (not just one event per
+	// call: several clients' contributions routinely coalesce into a
+	// single batch), for clients that only care about each contribution's
+	// most recent state.
+	ACKLastEvents func([]Event)
+
+	// ACKMeta is called with the EventMeta of every ACKed event (acked
+	// count passed separately), including dropped ones, without
+	// retaining the full event payloads.
+	ACKMeta func([]EventMeta, int)
+}
@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+// ACKBus fans out collected ACK batches to any number of subscribers,
+// replacing the single `beat.PipelineACKHandler` callback that used to be
+// the only way to observe ACKs. Registrar-style persistence, metrics and
+// user-supplied handlers can all subscribe independently.
+type ACKBus struct {
+	mu          sync.RWMutex
+	subscribers map[*ackSubscription]struct{}
+}
+
+// ACKEvent is delivered to a subscriber for each collected ACK batch. Which
+// fields are populated depends on the mode the subscriber registered with:
+// countACKMode leaves Events and Meta nil, lastEventsACKMode populates
+// Events with one event per client contribution collected into the batch
+// (see ACKBus.publish), eventsACKMode carries the full batch, metaACKMode
+// leaves Events nil and carries only Meta.
+type ACKEvent struct {
+	Total  int
+	Acked  int
+	Events []beat.Event
+	Meta   []beat.EventMeta
+}
+
+// CancelFunc unsubscribes a subscriber from the ACKBus. It is safe to call
+// more than once.
+type CancelFunc func()
+
+// SlowConsumerPolicy controls what happens when a subscriber's channel is
+// full at publish time.
+type SlowConsumerPolicy uint8
+
+const (
+	// DropOldest discards the oldest buffered event to make room for the
+	// new one. This is the default, favoring liveness over completeness.
+	DropOldest SlowConsumerPolicy = iota
+
+	// Block makes the publisher wait until the subscriber has room. A slow
+	// or stuck subscriber using this policy will backpressure the whole
+	// pipeline worker.
+	Block
+
+	// Disconnect cancels the subscription the first time it falls behind.
+	Disconnect
+)
+
+const defaultSubscriberBufferSize = 64
+
+// SubscribeOption customizes a single ACKBus.Subscribe call.
+type SubscribeOption func(*ackSubscription)
+
+// WithBufferSize overrides the default bounded channel size for a
+// subscriber.
+func WithBufferSize(n int) SubscribeOption {
+	return func(s *ackSubscription) { s.bufferSize = n }
+}
+
+// WithSlowConsumerPolicy overrides the default DropOldest policy for a
+// subscriber.
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) SubscribeOption {
+	return func(s *ackSubscription) { s.policy = policy }
+}
+
+type ackSubscription struct {
+	mode       pipelineACKMode
+	bufferSize int
+	policy     SlowConsumerPolicy
+
+	mu     sync.Mutex
+	ch     chan ACKEvent
+	closed bool
+}
+
+// NewACKBus creates an empty ACKBus ready to accept subscribers.
+func NewACKBus() *ACKBus {
+	return &ACKBus{subscribers: map[*ackSubscription]struct{}{}}
+}
+
+// Subscribe registers a new subscriber for ACK batches, returning a channel
+// of events shaped according to mode and a CancelFunc to unsubscribe. The
+// channel is closed once CancelFunc is called.
+func (b *ACKBus) Subscribe(mode pipelineACKMode, opts ...SubscribeOption) (<-chan ACKEvent, CancelFunc) {
+	sub := &ackSubscription{
+		mode:       mode,
+		bufferSize: defaultSubscriberBufferSize,
+		policy:     DropOldest,
+	}
+	for _, opt := range opts {
+		opt(sub)
+	}
+	sub.ch = make(chan ACKEvent, sub.bufferSize)
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() { b.unsubscribe(sub) }
+	return sub.ch, cancel
+}
+
+func (b *ACKBus) unsubscribe(sub *ackSubscription) {
+	b.mu.Lock()
+	delete(b.subscribers, sub)
+	b.mu.Unlock()
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ch)
+	}
+}
+
+// needsEvents reports whether any subscriber's mode requires the full
+// []beat.Event batch (eventsACKMode or lastEventsACKMode), so a caller
+// collecting a batch (see pipelineEventCB.collect) knows whether it is
+// worth retaining full event payloads at all, rather than just the
+// lighter per-event beat.EventMeta every mode can be served from.
+func (b *ACKBus) needsEvents() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		if sub.mode == eventsACKMode || sub.mode == lastEventsACKMode {
+			return true
+		}
+	}
+	return false
+}
+
+// publish fans the collected batch out to every subscriber, shaping Events
+// and Meta according to each subscriber's mode. events and lastEvents may
+// be nil if no subscriber needed full events (see needsEvents); metas is
+// always populated from every collected event, independent of events.
+//
+// lastEvents carries one event per collected eventsMsg (see
+// pipelineEventCB.collect), not just the single last event of the whole
+// batch: a batch routinely coalesces several concurrently-publishing
+// clients' contributions, and each one's last event needs to reach a
+// lastEventsACKMode subscriber.
+func (b *ACKBus) publish(total, acked int, events, lastEvents []beat.Event, metas []beat.EventMeta) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		b.deliver(sub, total, acked, events, lastEvents, metas)
+	}
+}
+
+func (b *ACKBus) deliver(sub *ackSubscription, total, acked int, events, lastEvents []beat.Event, metas []beat.EventMeta) {
+	evt := ACKEvent{Total: total, Acked: acked}
+	switch sub.mode {
+	case eventsACKMode:
+		evt.Events = events
+	case lastEventsACKMode:
+		evt.Events = lastEvents
+	case metaACKMode:
+		evt.Meta = metas
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+
+	select {
+	case sub.ch <- evt:
+		return
+	default:
+	}
+
+	switch sub.policy {
+	case Block:
+		sub.ch <- evt
+	case Disconnect:
+		sub.closed = true
+		close(sub.ch)
+	case DropOldest:
+		fallthrough
+	default:
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- evt:
+		default:
+		}
+	}
+}
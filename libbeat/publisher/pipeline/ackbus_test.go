@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+func TestACKBusNeedsEvents(t *testing.T) {
+	b := NewACKBus()
+	if b.needsEvents() {
+		t.Fatal("expected needsEvents to be false with no subscribers")
+	}
+
+	_, cancelCount := b.Subscribe(countACKMode)
+	_, cancelMeta := b.Subscribe(metaACKMode)
+	if b.needsEvents() {
+		t.Fatal("expected needsEvents to be false with only count/meta subscribers")
+	}
+
+	_, cancelEvents := b.Subscribe(eventsACKMode)
+	if !b.needsEvents() {
+		t.Fatal("expected needsEvents to be true once an eventsACKMode subscriber joins")
+	}
+
+	cancelEvents()
+	if b.needsEvents() {
+		t.Fatal("expected needsEvents to be false again after the eventsACKMode subscriber leaves")
+	}
+
+	_, cancelLast := b.Subscribe(lastEventsACKMode)
+	if !b.needsEvents() {
+		t.Fatal("expected needsEvents to be true for a lastEventsACKMode subscriber")
+	}
+
+	cancelLast()
+	cancelCount()
+	cancelMeta()
+}
+
+func TestACKBusPublishShapesPerMode(t *testing.T) {
+	b := NewACKBus()
+
+	countCh, cancelCount := b.Subscribe(countACKMode)
+	eventsCh, cancelEvents := b.Subscribe(eventsACKMode)
+	lastCh, cancelLast := b.Subscribe(lastEventsACKMode)
+	metaCh, cancelMeta := b.Subscribe(metaACKMode)
+	defer cancelCount()
+	defer cancelEvents()
+	defer cancelLast()
+	defer cancelMeta()
+
+	events := []beat.Event{
+		{Meta: beat.EventMeta{Source: "one"}},
+		{Meta: beat.EventMeta{Source: "two"}},
+	}
+	lastEvents := []beat.Event{events[1]}
+	metas := metaFromEvents(events)
+
+	b.publish(2, 2, events, lastEvents, metas)
+
+	select {
+	case evt := <-countCh:
+		if evt.Total != 2 || evt.Acked != 2 || evt.Events != nil || evt.Meta != nil {
+			t.Fatalf("countACKMode subscriber got unexpected event: %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("countACKMode subscriber never received the event")
+	}
+
+	select {
+	case evt := <-eventsCh:
+		if len(evt.Events) != 2 {
+			t.Fatalf("eventsACKMode subscriber expected the full batch, got %+v", evt.Events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("eventsACKMode subscriber never received the event")
+	}
+
+	select {
+	case evt := <-lastCh:
+		if len(evt.Events) != 1 || evt.Events[0].Meta.Source != "two" {
+			t.Fatalf("lastEventsACKMode subscriber expected [two], got %+v", evt.Events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lastEventsACKMode subscriber never received the event")
+	}
+
+	select {
+	case evt := <-metaCh:
+		if len(evt.Meta) != 2 {
+			t.Fatalf("metaACKMode subscriber expected 2 meta entries, got %+v", evt.Meta)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("metaACKMode subscriber never received the event")
+	}
+}
+
+func TestACKBusSlowConsumerDropOldest(t *testing.T) {
+	b := NewACKBus()
+	ch, cancel := b.Subscribe(countACKMode, WithBufferSize(1))
+	defer cancel()
+
+	b.publish(1, 1, nil, nil, nil)
+	b.publish(2, 2, nil, nil, nil)
+
+	select {
+	case evt := <-ch:
+		if evt.Total != 2 {
+			t.Fatalf("expected DropOldest to keep the newest event (Total=2), got %d", evt.Total)
+		}
+	default:
+		t.Fatal("expected a buffered event after two publishes")
+	}
+}
+
+func TestACKBusSlowConsumerBlock(t *testing.T) {
+	b := NewACKBus()
+	ch, cancel := b.Subscribe(countACKMode, WithBufferSize(1), WithSlowConsumerPolicy(Block))
+	defer cancel()
+
+	b.publish(1, 1, nil, nil, nil)
+
+	done := make(chan struct{})
+	go func() {
+		b.publish(2, 2, nil, nil, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected the second publish to block while the subscriber's buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-ch // drain the first event, making room
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the blocked publish to complete once the subscriber had room")
+	}
+}
+
+func TestACKBusSlowConsumerDisconnect(t *testing.T) {
+	b := NewACKBus()
+	ch, cancel := b.Subscribe(countACKMode, WithBufferSize(1), WithSlowConsumerPolicy(Disconnect))
+	defer cancel()
+
+	b.publish(1, 1, nil, nil, nil)
+	b.publish(2, 2, nil, nil, nil)
+
+	// Disconnect closes the subscriber's channel the first time it falls
+	// behind: draining it should yield the one buffered event followed by
+	// a closed channel, rather than ever seeing the second publish.
+	first, ok := <-ch
+	if !ok || first.Total != 1 {
+		t.Fatalf("expected the buffered first event before disconnect, got %+v (ok=%v)", first, ok)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("expected the channel to be closed after a Disconnect policy subscriber falls behind")
+	}
+}
@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// batchConfig tunes the adaptive ACK batcher used by pipelineEventCB's
+// worker loop to coalesce multiple reportBrokerACK calls into a single
+// collect() pass when the ACK handler is the bottleneck.
+type batchConfig struct {
+	// MinBatch is the broker ACK count below which the batcher drains
+	// already-pending broker ACKs, whenever the handler is slower than
+	// ACKs are arriving. A broker ACK already at or above MinBatch is
+	// collected on its own; once draining starts, it continues up to
+	// MaxBatch while ACKs are pending.
+	MinBatch int
+
+	// MaxBatch caps how many broker ACKs are coalesced into one collect()
+	// call, so a burst can't starve clients waiting on their signal for
+	// an unbounded amount of time.
+	MaxBatch int
+
+	// Decay is the EWMA smoothing factor (0, 1] applied to both the
+	// inter-arrival and handler-latency estimates on every sample. Higher
+	// values track recent behavior more closely; lower values smooth out
+	// noise.
+	Decay float64
+}
+
+func defaultBatchConfig() batchConfig {
+	return batchConfig{
+		MinBatch: 2,
+		MaxBatch: 1024,
+		Decay:    0.2,
+	}
+}
+
+// ackBatcher decides, for each broker ACK, whether the worker should drain
+// further already-pending ACKs from the broker channel before running
+// collect(), based on an EWMA of inter-ACK arrival time versus handler
+// latency. When the handler is slower than ACKs are arriving, draining
+// amortizes its cost over a bigger batch instead of blocking producers on
+// every single ACK.
+type ackBatcher struct {
+	cfg batchConfig
+
+	mu             sync.Mutex
+	lastArrival    time.Time
+	interArrival   time.Duration
+	handlerLatency time.Duration
+}
+
+func newACKBatcher(cfg batchConfig) *ackBatcher {
+	return &ackBatcher{cfg: cfg}
+}
+
+// recordArrival updates the inter-arrival EWMA with the time since the
+// previous broker ACK.
+func (b *ackBatcher) recordArrival(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.lastArrival.IsZero() {
+		b.interArrival = ewma(b.interArrival, now.Sub(b.lastArrival), b.cfg.Decay)
+	}
+	b.lastArrival = now
+}
+
+// recordLatency updates the handler-latency EWMA with the duration of the
+// most recent collect() call.
+func (b *ackBatcher) recordLatency(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlerLatency = ewma(b.handlerLatency, d, b.cfg.Decay)
+}
+
+// shouldDrain reports whether the handler is currently slower than ACKs
+// are arriving, meaning it pays off to coalesce pending ACKs rather than
+// invoke the handler once per broker ACK. have is the count already
+// collected for the in-flight broker ACK; at or above cfg.MinBatch (or
+// cfg.MaxBatch), coalescing is skipped since the batch is already big
+// enough.
+func (b *ackBatcher) shouldDrain(have int) bool {
+	if have >= b.cfg.MaxBatch {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.handlerLatency > b.interArrival && have < b.cfg.MinBatch
+}
+
+// drain non-blockingly pulls pending counts off acks, summing them, so the
+// caller can fold them into the current collect() call instead of
+// processing every broker ACK singly. It never pulls the running total
+// past cfg.MaxBatch, and never blocks: it returns as soon as acks has
+// nothing more buffered.
+func (b *ackBatcher) drain(acks chan int, have int) (extra int) {
+	for have+extra < b.cfg.MaxBatch {
+		select {
+		case count := <-acks:
+			extra += count
+		default:
+			return extra
+		}
+	}
+	return extra
+}
+
+func ewma(prev, sample time.Duration, decay float64) time.Duration {
+	if prev == 0 {
+		return sample
+	}
+	return time.Duration(decay*float64(sample) + (1-decay)*float64(prev))
+}
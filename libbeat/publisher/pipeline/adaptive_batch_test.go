@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+func TestACKBatcherShouldDrain(t *testing.T) {
+	b := newACKBatcher(batchConfig{MinBatch: 10, MaxBatch: 100, Decay: 1})
+
+	// no samples yet: both EWMAs are zero, so nothing looks slow
+	if b.shouldDrain(1) {
+		t.Fatal("expected shouldDrain to be false before any samples")
+	}
+
+	b.recordArrival(time.Unix(0, 0))
+	b.recordArrival(time.Unix(0, int64(10*time.Millisecond)))
+	b.recordLatency(50 * time.Millisecond)
+
+	if !b.shouldDrain(1) {
+		t.Fatal("expected shouldDrain to be true once handler latency exceeds inter-arrival time")
+	}
+	if b.shouldDrain(10) {
+		t.Fatal("expected shouldDrain to be false once have reaches MinBatch")
+	}
+}
+
+func TestACKBatcherDrain(t *testing.T) {
+	b := newACKBatcher(batchConfig{MinBatch: 10, MaxBatch: 5, Decay: 0.2})
+
+	acks := make(chan int, 10)
+	for i := 0; i < 6; i++ {
+		acks <- 1
+	}
+
+	// have=1, MaxBatch=5: drain should stop once have+extra reaches 5,
+	// leaving two of the six ACKs unread rather than blocking or
+	// overshooting.
+	extra := b.drain(acks, 1)
+	if extra != 4 {
+		t.Fatalf("expected drain to cap at MaxBatch, got extra=%d", extra)
+	}
+	if len(acks) != 2 {
+		t.Fatalf("expected 2 ACKs left undrained, got %d", len(acks))
+	}
+}
+
+// BenchmarkPipelineEventCBSingle measures the synchronous one-ACK-at-a-time
+// path: every reportBrokerACK triggers its own collect() call. collect()
+// blocks until it has read a matching onCounts for the ACK, so a producer
+// goroutine feeds those in lockstep with the benchmark loop reporting
+// broker ACKs.
+func BenchmarkPipelineEventCBSingle(b *testing.B) {
+	// MaxBatch 1 keeps the batcher from ever coalescing broker ACKs.
+	cb, err := newPipelineEventCBWithConfig(pipelineEventCBConfig{
+		Handler: beat.PipelineACKHandler{
+			ACKCount: func(int) {},
+		},
+		CheckpointConfig: defaultCheckpointConfig(),
+		BatchConfig:      batchConfig{MinBatch: 1, MaxBatch: 1, Decay: 0.2},
+	})
+	if err != nil || cb == nil {
+		b.Fatalf("newPipelineEventCBWithConfig failed: %v", err)
+	}
+	defer cb.close()
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < b.N; i++ {
+			cb.onCounts(ctx, 1, 1)
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cb.reportBrokerACK(1)
+	}
+	<-done
+}
+
+// BenchmarkPipelineEventCBAdaptiveBatching measures the same workload once
+// the handler is slow enough that the adaptive batcher starts coalescing
+// broker ACKs, showing reduced contention on the shared acks channel.
+func BenchmarkPipelineEventCBAdaptiveBatching(b *testing.B) {
+	cb, err := newPipelineEventCBWithConfig(pipelineEventCBConfig{
+		Handler: beat.PipelineACKHandler{
+			ACKCount: func(int) { time.Sleep(time.Microsecond) },
+		},
+		CheckpointConfig: defaultCheckpointConfig(),
+		BatchConfig:      batchConfig{MinBatch: 64, MaxBatch: 1024, Decay: 0.2},
+	})
+	if err != nil || cb == nil {
+		b.Fatalf("newPipelineEventCBWithConfig failed: %v", err)
+	}
+	defer cb.close()
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < b.N; i++ {
+			cb.onCounts(ctx, 1, 1)
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cb.reportBrokerACK(1)
+	}
+	<-done
+}
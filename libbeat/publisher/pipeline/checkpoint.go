@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+// CheckpointStore persists the state derived from ACKed events, so a beat
+// can resume from the last known-good position after a restart. Commit is
+// called with the latest serialized state whenever the checkpointer decides
+// to flush (see checkpointConfig); Load is called once at pipeline startup
+// to recover the last persisted state.
+type CheckpointStore interface {
+	// Commit persists state, replacing any previously committed state.
+	Commit(state []byte) error
+
+	// Load returns the last state committed via Commit, or a nil slice if
+	// no state has been committed yet.
+	Load() ([]byte, error)
+}
+
+// checkpointConfig controls how often the checkpointer flushes pending
+// state to the configured CheckpointStore.
+type checkpointConfig struct {
+	// FlushCount flushes after this many ACKs have accumulated since the
+	// last flush. A value <= 0 disables the count-based trigger.
+	FlushCount int
+
+	// FlushTimeout flushes after this much time has elapsed since the
+	// oldest pending ACK. A value <= 0 disables the time-based trigger.
+	FlushTimeout time.Duration
+}
+
+func defaultCheckpointConfig() checkpointConfig {
+	return checkpointConfig{
+		FlushCount:   1024,
+		FlushTimeout: 1 * time.Second,
+	}
+}
+
+// checkpointer batches state updates derived from ACKed events and flushes
+// them to a CheckpointStore, so the store is not written to on every single
+// ACK. Progress is tracked per input (keyed by beat.EventMeta.InputID, or
+// Source if InputID is unset), since a single collected ACK batch routinely
+// contains events from several concurrently-publishing inputs and each
+// one's offset must be persisted independently.
+type checkpointer struct {
+	config checkpointConfig
+	store  CheckpointStore
+
+	mu      sync.Mutex
+	pending map[string]beat.EventMeta
+	count   int
+	timer   *time.Timer
+}
+
+// newCheckpointer creates a checkpointer writing through to store. If store
+// is nil, the returned checkpointer is a no-op, so callers do not need to
+// special-case the "no persistence configured" case.
+func newCheckpointer(store CheckpointStore, config checkpointConfig) *checkpointer {
+	return &checkpointer{store: store, config: config}
+}
+
+// recover loads the last committed state, for replay by the caller during
+// pipeline startup. It returns a nil slice and no error if nothing has been
+// committed yet or no store is configured.
+func (c *checkpointer) recover() ([]byte, error) {
+	if c.store == nil {
+		return nil, nil
+	}
+	return c.store.Load()
+}
+
+// update merges the per-input state carried in metas into the pending
+// checkpoint, one entry per input, and flushes immediately if the
+// configured count or timeout threshold has been reached. Later offsets
+// for a given input overwrite earlier ones; inputs not represented in
+// metas are left untouched.
+func (c *checkpointer) update(metas []beat.EventMeta) error {
+	if c.store == nil || len(metas) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = map[string]beat.EventMeta{}
+	}
+	for _, meta := range metas {
+		c.pending[checkpointKey(meta)] = meta
+	}
+	c.count++
+	count := c.count
+	if c.timer == nil && c.config.FlushTimeout > 0 {
+		c.timer = time.AfterFunc(c.config.FlushTimeout, c.flushOnTimeout)
+	}
+	c.mu.Unlock()
+
+	if c.config.FlushCount > 0 && count >= c.config.FlushCount {
+		return c.flush()
+	}
+	return nil
+}
+
+// checkpointKey identifies the input a beat.EventMeta belongs to, falling
+// back to Source when InputID hasn't been set.
+func checkpointKey(meta beat.EventMeta) string {
+	if meta.InputID != "" {
+		return meta.InputID
+	}
+	return meta.Source
+}
+
+func (c *checkpointer) flushOnTimeout() {
+	_ = c.flush()
+}
+
+// flush commits the per-input checkpoint state built up by update to the
+// store, if any is outstanding.
+func (c *checkpointer) flush() error {
+	c.mu.Lock()
+	pending := c.pending
+	outstanding := c.count > 0
+	c.count = 0
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+
+	if !outstanding || len(pending) == 0 {
+		return nil
+	}
+
+	state, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return c.store.Commit(state)
+}
+
+// close flushes any pending state and releases the checkpointer's timer.
+func (c *checkpointer) close() error {
+	return c.flush()
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+// stubCheckpointStore is an in-memory CheckpointStore test double, so
+// checkpointer's batching/merging logic can be exercised without touching
+// the filesystem.
+type stubCheckpointStore struct {
+	mu      sync.Mutex
+	state   []byte
+	commits int
+}
+
+func (s *stubCheckpointStore) Commit(state []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = append([]byte(nil), state...)
+	s.commits++
+	return nil
+}
+
+func (s *stubCheckpointStore) Load() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, nil
+}
+
+func (s *stubCheckpointStore) snapshot() ([]byte, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.commits
+}
+
+// TestCheckpointerUpdateMergesPerInput verifies that update merges each
+// input's state independently: a later offset for one input must not
+// clobber another input's already-persisted offset.
+func TestCheckpointerUpdateMergesPerInput(t *testing.T) {
+	store := &stubCheckpointStore{}
+	c := newCheckpointer(store, checkpointConfig{FlushCount: 1})
+
+	if err := c.update([]beat.EventMeta{
+		{InputID: "input-a", Offset: 1},
+		{InputID: "input-b", Offset: 10},
+	}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := c.update([]beat.EventMeta{
+		{InputID: "input-a", Offset: 2},
+	}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	state, _ := store.snapshot()
+	var committed map[string]beat.EventMeta
+	if err := json.Unmarshal(state, &committed); err != nil {
+		t.Fatalf("failed to unmarshal committed state: %v", err)
+	}
+	if got := committed["input-a"].Offset; got != 2 {
+		t.Fatalf("expected input-a's offset to be overwritten to 2, got %d", got)
+	}
+	if got := committed["input-b"].Offset; got != 10 {
+		t.Fatalf("expected input-b's offset to be left untouched at 10, got %d", got)
+	}
+}
+
+// TestCheckpointerFlushCount verifies that flush is deferred until
+// FlushCount updates have accumulated.
+func TestCheckpointerFlushCount(t *testing.T) {
+	store := &stubCheckpointStore{}
+	c := newCheckpointer(store, checkpointConfig{FlushCount: 2})
+
+	if err := c.update([]beat.EventMeta{{InputID: "a", Offset: 1}}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if _, commits := store.snapshot(); commits != 0 {
+		t.Fatalf("expected no flush before FlushCount is reached, got %d commits", commits)
+	}
+
+	if err := c.update([]beat.EventMeta{{InputID: "a", Offset: 2}}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if _, commits := store.snapshot(); commits != 1 {
+		t.Fatalf("expected exactly one flush once FlushCount is reached, got %d commits", commits)
+	}
+}
+
+// TestCheckpointerFlushTimeout verifies that pending state is flushed once
+// FlushTimeout elapses, even without FlushCount ever being reached.
+func TestCheckpointerFlushTimeout(t *testing.T) {
+	store := &stubCheckpointStore{}
+	c := newCheckpointer(store, checkpointConfig{FlushTimeout: 20 * time.Millisecond})
+	defer c.close()
+
+	if err := c.update([]beat.EventMeta{{InputID: "a", Offset: 1}}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, commits := store.snapshot(); commits > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("expected FlushTimeout to trigger a flush without an explicit FlushCount")
+}
+
+// TestFileCheckpointStoreRoundTrip verifies that a fileCheckpointStore's
+// Commit/Load round-trip survives the atomic temp-file-plus-rename write.
+func TestFileCheckpointStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileCheckpointStore(filepath.Join(dir, "checkpoint"))
+
+	if state, err := store.Load(); err != nil || state != nil {
+		t.Fatalf("expected no state before any Commit, got state=%v err=%v", state, err)
+	}
+
+	want := []byte(`{"input-a":{"Offset":1}}`)
+	if err := store.Commit(want); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("expected Load to round-trip the committed state, got %q want %q", got, want)
+	}
+}
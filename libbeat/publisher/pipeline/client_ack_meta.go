@@ -0,0 +1,22 @@
+package pipeline
+
+import "github.com/elastic/beats/libbeat/publisher/beat"
+
+// buildClientMetaACK builds a meta-only client acker on top of
+// buildClientEventACK, translating its event batch down to the lighter
+// []beat.EventMeta shape that ACKMeta subscribers want. This keeps the
+// client-acker wiring itself (acker/sema/clientACKer) in a single place
+// instead of duplicating buildClientEventACK for the meta-only case.
+func buildClientMetaACK(
+	pipeline *Pipeline,
+	canDrop bool,
+	sema *sema,
+	fn func(guard *clientACKer) func([]beat.EventMeta, int),
+) acker {
+	return buildClientEventACK(pipeline, canDrop, sema, func(guard *clientACKer) func([]beat.Event, int) {
+		onMeta := fn(guard)
+		return func(events []beat.Event, acked int) {
+			onMeta(metaFromEvents(events), acked)
+		}
+	})
+}
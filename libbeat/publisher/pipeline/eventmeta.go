@@ -0,0 +1,24 @@
+package pipeline
+
+import "github.com/elastic/beats/libbeat/publisher/beat"
+
+// metaFromEvents extracts the beat.EventMeta attached to each event, for
+// delivery to metaACKMode subscribers. Unlike the full beat.Event, this
+// lets ACK consumers persist per-input progress (input ID, offset/sequence)
+// without retaining the event payloads, which matters for high-volume
+// inputs where eventsACKMode's memory footprint is prohibitive.
+//
+// Dropped events still carry their Meta, so a consumer only interested in
+// offsets sees every event's progress regardless of whether it was
+// actually published.
+func metaFromEvents(events []beat.Event) []beat.EventMeta {
+	if len(events) == 0 {
+		return nil
+	}
+
+	meta := make([]beat.EventMeta, len(events))
+	for i := range events {
+		meta[i] = events[i].Meta
+	}
+	return meta
+}
@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+// TestMetaACKModeSurfacesDroppedEvents verifies that events dropped by the
+// pipeline (acked=0) still reach an ACKMeta subscriber with their Meta
+// intact, so a registrar-style consumer can track input progress even for
+// events that never made it to an output. It also asserts on the acked
+// count ACKMeta's second argument carries: per beat.PipelineACKHandler's
+// doc comment this is the number of events actually acked, not the total
+// including drops, so a dropped event must report 0 here.
+func TestMetaACKModeSurfacesDroppedEvents(t *testing.T) {
+	type result struct {
+		meta  []beat.EventMeta
+		acked int
+	}
+	got := make(chan result, 1)
+
+	cb, err := newPipelineEventCB(beat.PipelineACKHandler{
+		ACKMeta: func(meta []beat.EventMeta, acked int) {
+			got <- result{meta, acked}
+		},
+	})
+	if err != nil {
+		t.Fatalf("newPipelineEventCB failed: %v", err)
+	}
+	defer cb.close()
+
+	dropped := beat.Event{Meta: beat.EventMeta{Source: "dropped-input"}}
+
+	done := make(chan struct{})
+	go func() {
+		// acked=0 routes through p.droppedEvents, bypassing collect().
+		cb.onEvents(context.Background(), []beat.Event{dropped}, 0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onEvents did not return for dropped event")
+	}
+
+	select {
+	case r := <-got:
+		if len(r.meta) != 1 || r.meta[0].Source != "dropped-input" {
+			t.Fatalf("expected dropped event's meta to surface, got %+v", r.meta)
+		}
+		if r.acked != 0 {
+			t.Fatalf("expected acked count 0 for a dropped event, got %d", r.acked)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ACKMeta was never called for the dropped event")
+	}
+}
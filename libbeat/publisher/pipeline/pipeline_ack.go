@@ -1,8 +1,13 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
 
+	"github.com/elastic/beats/libbeat/logp"
 	"github.com/elastic/beats/libbeat/publisher/beat"
 )
 
@@ -10,6 +15,7 @@ type ackBuilder interface {
 	createPipelineACKer(canDrop bool, sema *sema) acker
 	createCountACKer(canDrop bool, sema *sema, fn func(int)) acker
 	createEventACKer(canDrop bool, sema *sema, fn func([]beat.Event)) acker
+	createMetaACKer(canDrop bool, sema *sema, fn func([]beat.EventMeta, int)) acker
 }
 
 type pipelineEmptyACK struct {
@@ -44,6 +50,20 @@ func (b *pipelineEmptyACK) createEventACKer(
 	})
 }
 
+func (b *pipelineEmptyACK) createMetaACKer(
+	canDrop bool,
+	sema *sema,
+	fn func([]beat.EventMeta, int),
+) acker {
+	return buildClientMetaACK(b.pipeline, canDrop, sema, func(guard *clientACKer) func([]beat.EventMeta, int) {
+		return func(meta []beat.EventMeta, acked int) {
+			if guard.Active() {
+				fn(meta, acked)
+			}
+		}
+	})
+}
+
 type pipelineCountACK struct {
 	pipeline *Pipeline
 	cb       func(int, int)
@@ -79,6 +99,21 @@ func (b *pipelineCountACK) createEventACKer(
 	})
 }
 
+func (b *pipelineCountACK) createMetaACKer(
+	canDrop bool,
+	sema *sema,
+	fn func([]beat.EventMeta, int),
+) acker {
+	return buildClientMetaACK(b.pipeline, canDrop, sema, func(guard *clientACKer) func([]beat.EventMeta, int) {
+		return func(meta []beat.EventMeta, acked int) {
+			b.cb(len(meta), acked)
+			if guard.Active() {
+				fn(meta, acked)
+			}
+		}
+	})
+}
+
 type pipelineEventsACK struct {
 	pipeline *Pipeline
 	cb       func([]beat.Event, int)
@@ -110,15 +145,35 @@ func (b *pipelineEventsACK) createEventACKer(canDrop bool, sema *sema, fn func([
 	})
 }
 
+// createMetaACKer builds the meta-only acker on top of buildClientEventACK
+// (rather than buildClientMetaACK): this builder's own callback needs the
+// full events, which only the event-level client acker retains.
+func (b *pipelineEventsACK) createMetaACKer(
+	canDrop bool,
+	sema *sema,
+	fn func([]beat.EventMeta, int),
+) acker {
+	return buildClientEventACK(b.pipeline, canDrop, sema, func(guard *clientACKer) func([]beat.Event, int) {
+		return func(events []beat.Event, acked int) {
+			b.cb(events, acked)
+			if guard.Active() {
+				fn(metaFromEvents(events), acked)
+			}
+		}
+	})
+}
+
 // pipelineEventCB internally handles active ACKs in the pipeline.
 // It receives ACK events from the broker and the individual clients.
 // Once the broker returns an ACK to the pipelineEventCB, the worker loop will collect
 // events from all clients having published events in the last batch of events
 // being ACKed.
-// the PipelineACKHandler will be notified, once all events being ACKed
-// (including dropped events) have been collected. Only one ACK-event is handled
-// at a time. The pipeline global and clients ACK handler will be blocked for the time
-// an ACK event is being processed.
+// Once all events being ACKed (including dropped events) have been collected,
+// the batch is published on the ACKBus, which fans it out to every
+// subscriber: the PipelineACKHandler passed in at construction time (via
+// forwardToHandler) as well as any other subscriber added through Bus().
+// Only one ACK-event is handled at a time. The pipeline global and clients
+// ACK handler will be blocked for the time an ACK event is being processed.
 type pipelineEventCB struct {
 	done chan struct{}
 
@@ -129,6 +184,48 @@ type pipelineEventCB struct {
 
 	mode    pipelineACKMode
 	handler beat.PipelineACKHandler
+
+	// bus fans out each collected ACK batch to the handler subscription
+	// below as well as any other subscriber (registrar, metrics, ...)
+	// added via Bus().Subscribe.
+	bus           *ACKBus
+	cancelHandler CancelFunc
+
+	// checkpoint persists per-input progress derived from each ACKed
+	// event's beat.EventMeta (see checkpointer.update), if the pipeline was
+	// configured with a CheckpointStore. When no persistence is
+	// configured it is a no-op checkpointer (see newCheckpointer).
+	checkpoint *checkpointer
+
+	// recovered holds the state loaded from the CheckpointStore at
+	// startup, so the beat can replay from the last known-good position.
+	// It is nil if no state was recovered.
+	recovered []byte
+
+	// ackTimeout bounds how long onEvents/onCounts will wait on the worker
+	// before giving up, so a stuck worker goroutine cannot deadlock a
+	// client shutdown. <= 0 disables the timeout.
+	ackTimeout time.Duration
+
+	// ackTimeouts counts how many onEvents/onCounts/reportBrokerACK calls
+	// gave up due to ackTimeout, pipeline shutdown or (for
+	// onEvents/onCounts) context cancellation, for diagnosing a wedged
+	// pipeline.
+	ackTimeouts uint64
+
+	// collectTimeouts counts how many collect() rounds gave up waiting on
+	// a client's contribution to an in-flight broker ACK, rather than a
+	// client giving up on its own onEvents/onCounts call (ackTimeouts
+	// above). The two are distinct failure modes: ackTimeouts means a
+	// client observed lag; collectTimeouts means a client abandoned its
+	// send before delivering, which would otherwise wedge the worker (and
+	// every other client's ACKs behind it) waiting for a contribution
+	// that is never coming.
+	collectTimeouts uint64
+
+	// batcher decides when to coalesce multiple pending broker ACKs into
+	// a single collect() pass; see adaptive_batch.go.
+	batcher *ackBatcher
 }
 
 type eventsMsg struct {
@@ -144,9 +241,43 @@ const (
 	countACKMode
 	eventsACKMode
 	lastEventsACKMode
+	metaACKMode
 )
 
+// pipelineEventCBConfig aggregates the optional knobs newPipelineEventCB
+// can be built with, on top of the required handler. Callers that only
+// need the handler should use newPipelineEventCB instead of constructing
+// this directly.
+type pipelineEventCBConfig struct {
+	Handler beat.PipelineACKHandler
+
+	CheckpointStore  CheckpointStore
+	CheckpointConfig checkpointConfig
+
+	// ACKTimeout bounds how long a client's onEvents/onCounts call will
+	// wait on the worker. <= 0 disables the timeout (the default).
+	ACKTimeout time.Duration
+
+	// BatchConfig tunes the adaptive batching of broker ACKs; see
+	// adaptive_batch.go. The zero value disables coalescing (MaxBatch 0
+	// means shouldDrain never fires); newPipelineEventCB uses
+	// defaultBatchConfig().
+	BatchConfig batchConfig
+}
+
 func newPipelineEventCB(handler beat.PipelineACKHandler) (*pipelineEventCB, error) {
+	return newPipelineEventCBWithConfig(pipelineEventCBConfig{
+		Handler:          handler,
+		CheckpointConfig: defaultCheckpointConfig(),
+		BatchConfig:      defaultBatchConfig(),
+	})
+}
+
+// newPipelineEventCBWithConfig is like newPipelineEventCB, but also accepts
+// the optional checkpointing and ACK-timeout knobs described by cfg.
+func newPipelineEventCBWithConfig(cfg pipelineEventCBConfig) (*pipelineEventCB, error) {
+	handler := cfg.Handler
+
 	mode := noACKMode
 	if handler.ACKCount != nil {
 		mode = countACKMode
@@ -163,25 +294,90 @@ func newPipelineEventCB(handler beat.PipelineACKHandler) (*pipelineEventCB, erro
 		}
 		mode = lastEventsACKMode
 	}
+	if handler.ACKMeta != nil {
+		if mode != noACKMode {
+			return nil, errors.New("only one callback can be set")
+		}
+		mode = metaACKMode
+	}
 
 	// yay, no work
-	if mode == noACKMode {
+	if mode == noACKMode && cfg.CheckpointStore == nil {
 		return nil, nil
 	}
 
+	checkpoint := newCheckpointer(cfg.CheckpointStore, cfg.CheckpointConfig)
+	recovered, err := checkpoint.recover()
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover checkpoint state: %v", err)
+	}
+
 	cb := &pipelineEventCB{
+		done:          make(chan struct{}),
 		acks:          make(chan int),
 		mode:          mode,
 		handler:       handler,
 		events:        make(chan eventsMsg),
 		droppedEvents: make(chan eventsMsg),
+		bus:           NewACKBus(),
+		checkpoint:    checkpoint,
+		recovered:     recovered,
+		ackTimeout:    cfg.ACKTimeout,
+		batcher:       newACKBatcher(cfg.BatchConfig),
 	}
+
+	if mode != noACKMode {
+		ch, cancel := cb.bus.Subscribe(mode, WithSlowConsumerPolicy(Block))
+		cb.cancelHandler = cancel
+		go cb.forwardToHandler(ch)
+	}
+
 	go cb.worker()
 	return cb, nil
 }
 
+// Bus returns the ACKBus events are fanned out on, so other components
+// (registrar, metrics, ...) can subscribe independently of the handler
+// passed at construction time.
+func (p *pipelineEventCB) Bus() *ACKBus {
+	return p.bus
+}
+
+// forwardToHandler bridges the handler-based API to the bus: it runs for
+// the lifetime of the pipeline, translating each ACKEvent it receives into
+// the matching beat.PipelineACKHandler callback. Subscribed with the
+// Block policy, so the handler sees every batch, in order, exactly like it
+// did before the bus existed.
+func (p *pipelineEventCB) forwardToHandler(ch <-chan ACKEvent) {
+	for evt := range ch {
+		switch p.mode {
+		case countACKMode:
+			p.handler.ACKCount(evt.Total)
+		case eventsACKMode:
+			p.handler.ACKEvents(evt.Events)
+		case lastEventsACKMode:
+			p.handler.ACKLastEvents(evt.Events)
+		case metaACKMode:
+			p.handler.ACKMeta(evt.Meta, evt.Acked)
+		}
+	}
+}
+
+// RecoveredState returns the checkpoint state loaded at startup, so the
+// beat can replay from the last known-good position. It returns nil if no
+// CheckpointStore was configured or no state had been committed yet.
+func (p *pipelineEventCB) RecoveredState() []byte {
+	return p.recovered
+}
+
 func (p *pipelineEventCB) close() {
 	close(p.done)
+	if p.cancelHandler != nil {
+		p.cancelHandler()
+	}
+	if p.checkpoint != nil {
+		p.checkpoint.close()
+	}
 }
 
 // reportEvents sends a batch of ACKed events to the ACKer.
@@ -196,7 +392,12 @@ func (p *pipelineEventCB) close() {
 //       by the pipeline, before receiving/processing another ACK event.
 //       In the meantime the broker has the chance of batching-up more ACK events,
 //       such that only one ACK event is being reported to the pipeline handler
-func (p *pipelineEventCB) onEvents(events []beat.Event, acked int) {
+//
+// ctx is propagated from the originating client.Publish call: if ctx is
+// canceled, the pipeline is shutting down (p.done closed), or ackTimeout
+// elapses first, onEvents gives up waiting and returns rather than risking
+// a deadlock against a stuck worker goroutine.
+func (p *pipelineEventCB) onEvents(ctx context.Context, events []beat.Event, acked int) {
 	ch := p.events
 	if acked == 0 {
 		ch = p.droppedEvents
@@ -209,12 +410,10 @@ func (p *pipelineEventCB) onEvents(events []beat.Event, acked int) {
 		sig:    make(chan struct{}),
 	}
 
-	// send message to worker and wait for completion signal
-	ch <- msg
-	<-msg.sig
+	p.send(ctx, ch, msg)
 }
 
-func (p *pipelineEventCB) onCounts(total, acked int) {
+func (p *pipelineEventCB) onCounts(ctx context.Context, total, acked int) {
 	ch := p.events
 	if acked == 0 {
 		ch = p.droppedEvents
@@ -226,24 +425,109 @@ func (p *pipelineEventCB) onCounts(total, acked int) {
 		sig:   make(chan struct{}),
 	}
 
-	ch <- msg
-	<-msg.sig
+	p.send(ctx, ch, msg)
+}
+
+// send delivers msg to the worker on ch and waits for it to signal
+// completion, bailing out early on pipeline shutdown, ctx cancellation, or
+// p.ackTimeout, whichever comes first.
+func (p *pipelineEventCB) send(ctx context.Context, ch chan eventsMsg, msg eventsMsg) {
+	timeout, cancel := p.withACKTimeout(ctx)
+	defer cancel()
+
+	select {
+	case ch <- msg:
+	case <-p.done:
+		p.noteTimeout()
+		return
+	case <-timeout.Done():
+		p.noteTimeout()
+		return
+	}
+
+	select {
+	case <-msg.sig:
+	case <-p.done:
+		p.noteTimeout()
+	case <-timeout.Done():
+		p.noteTimeout()
+	}
+}
+
+func (p *pipelineEventCB) withACKTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.ackTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.ackTimeout)
+}
+
+func (p *pipelineEventCB) noteTimeout() {
+	atomic.AddUint64(&p.ackTimeouts, 1)
+}
+
+// ACKTimeouts reports how many onEvents/onCounts/reportBrokerACK calls
+// have given up waiting on the worker, due to ackTimeout, pipeline
+// shutdown, or (for onEvents/onCounts) context cancellation.
+func (p *pipelineEventCB) ACKTimeouts() uint64 {
+	return atomic.LoadUint64(&p.ackTimeouts)
+}
+
+// CollectTimeouts reports how many collect() rounds have given up waiting
+// on a client's contribution to an in-flight broker ACK; see
+// collectTimeouts.
+func (p *pipelineEventCB) CollectTimeouts() uint64 {
+	return atomic.LoadUint64(&p.collectTimeouts)
 }
 
 // Starts a new ACKed event.
+//
+// Like onEvents/onCounts, this selects on p.done/ackTimeout instead of
+// sending unconditionally: p.acks is never closed (the worker may exit
+// while a broker is still reporting ACKs), so an unconditional send would
+// otherwise block forever once the worker is gone.
 func (p *pipelineEventCB) reportBrokerACK(acked int) {
-	p.acks <- acked
+	if p.ackTimeout <= 0 {
+		select {
+		case p.acks <- acked:
+		case <-p.done:
+			p.noteTimeout()
+		}
+		return
+	}
+
+	timer := time.NewTimer(p.ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.acks <- acked:
+	case <-p.done:
+		p.noteTimeout()
+	case <-timer.C:
+		p.noteTimeout()
+	}
 }
 
+// worker never closes p.acks/p.events/p.droppedEvents: they are shared
+// send targets for reportBrokerACK/onEvents/onCounts, which may be called
+// concurrently with (or after) worker exiting on <-p.done. Closing them
+// here would make those sends panic instead of safely falling through to
+// their own p.done case once the worker is gone.
 func (p *pipelineEventCB) worker() {
-	defer close(p.acks)
-	defer close(p.events)
-	defer close(p.droppedEvents)
-
 	for {
 		select {
 		case count := <-p.acks:
+			now := time.Now()
+			p.batcher.recordArrival(now)
+
+			// if the handler has been slower than ACKs are arriving,
+			// coalesce whatever other broker ACKs are already pending
+			// instead of invoking the handler once per ACK
+			if p.batcher.shouldDrain(count) {
+				count += p.batcher.drain(p.acks, count)
+			}
+
 			exit := p.collect(count)
+			p.batcher.recordLatency(time.Since(now))
 			if exit {
 				return
 			}
@@ -251,7 +535,14 @@ func (p *pipelineEventCB) worker() {
 			// short circuite dropped events, but have client block until all events
 			// have been processed by pipeline ack handler
 		case msg := <-p.droppedEvents:
-			p.reportEvents(msg.events, msg.total)
+			var events, lastEvents []beat.Event
+			if p.bus.needsEvents() {
+				events = msg.events
+				if L := len(msg.events); L > 0 {
+					lastEvents = msg.events[L-1:]
+				}
+			}
+			p.reportEvents(events, lastEvents, metaFromEvents(msg.events), msg.total, msg.acked)
 			close(msg.sig)
 
 		case <-p.done:
@@ -262,20 +553,66 @@ func (p *pipelineEventCB) worker() {
 
 func (p *pipelineEventCB) collect(count int) (exit bool) {
 	var (
-		signalers []chan struct{}
-		events    []beat.Event
-		acked     int
-		total     int
+		signalers  []chan struct{}
+		events     []beat.Event
+		lastEvents []beat.Event
+		metas      []beat.EventMeta
+		acked      int
+		total      int
 	)
 
+	// Only retain the full event payloads if some subscriber actually
+	// needs them: countACKMode and metaACKMode (the common, high-volume
+	// cases) can be served entirely from the lightweight per-event Meta
+	// collected below, and building the full batch for them just to have
+	// the bus discard it again at publish time defeats the point of
+	// metaACKMode.
+	collectEvents := p.bus.needsEvents()
+
 	for acked < count {
+		// A client can abandon its send (ctx canceled, or its own
+		// ackTimeout) after the broker has already counted its
+		// contribution toward count, but before delivering an eventsMsg
+		// here: without an idle timeout this loop would wait forever for
+		// a contribution that is never coming, wedging every other
+		// client's ACKs behind it. Rearm a fresh per-iteration timer
+		// instead of one deadline for the whole round, since each
+		// arriving message resets how long it's reasonable to wait for
+		// the next one.
+		//
+		// Trade-off: giving up here means a straggler that does eventually
+		// arrive gets folded into whatever later collect() round happens to
+		// read it, rather than its original round (see the count-acked
+		// overshoot handling below). That favors overall liveness over
+		// per-round attribution precision, which is the right call: a
+		// wedged worker blocks every client's ACKs indefinitely, while a
+		// misattributed straggler only blurs which round its own checkpoint
+		// update lands in.
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if p.ackTimeout > 0 {
+			timer = time.NewTimer(p.ackTimeout)
+			timeout = timer.C
+		}
+
 		var msg eventsMsg
 		select {
 		case msg = <-p.events:
 		case msg = <-p.droppedEvents:
 		case <-p.done:
+			if timer != nil {
+				timer.Stop()
+			}
 			exit = true
 			return
+		case <-timeout:
+			atomic.AddUint64(&p.collectTimeouts, 1)
+			logp.Warn("giving up on %d acked events a client never delivered; it may have abandoned its ACK", count-acked)
+			p.finishCollect(signalers, events, lastEvents, metas, total, acked)
+			return
+		}
+		if timer != nil {
+			timer.Stop()
 		}
 
 		signalers = append(signalers, msg.sig)
@@ -283,36 +620,66 @@ func (p *pipelineEventCB) collect(count int) (exit bool) {
 		acked += msg.acked
 
 		if count-acked < 0 {
-			panic("ack count mismatch")
+			// A contribution collect() already gave up on in an earlier,
+			// timed-out round (see the ackTimeout case above) can still
+			// land here instead of being lost: the client's blocked send
+			// is serviced by whichever collect() call reads it next, not
+			// necessarily the round that originally counted it. Report
+			// this round with its real, overshot acked total rather than
+			// clamping it to count: total/acked must stay consistent with
+			// the events/metas already appended for this round, and the
+			// abandoned round's own report already went out short, so the
+			// count across both rounds still nets out correctly even
+			// though some of it ends up attributed to the wrong round.
+			logp.Warn("ACK count overshoot by %d, likely a contribution abandoned by an earlier collect() timeout", acked-count)
 		}
 
-		switch p.mode {
-		case eventsACKMode:
+		metas = append(metas, metaFromEvents(msg.events)...)
+		if collectEvents {
 			events = append(events, msg.events...)
-
-		case lastEventsACKMode:
+			// lastEvents carries one event per collected eventsMsg, not just
+			// the single last event of the whole batch: a round routinely
+			// coalesces several concurrently-publishing clients, and each
+			// one's own last event needs to reach a lastEventsACKMode
+			// subscriber (see ACKBus.publish).
 			if L := len(msg.events); L > 0 {
-				events = append(events, msg.events[L-1])
+				lastEvents = append(lastEvents, msg.events[L-1])
 			}
 		}
 	}
 
+	p.finishCollect(signalers, events, lastEvents, metas, total, acked)
+	return
+}
+
+// finishCollect signals every client waiting on this round and fans the
+// collected batch out, whether the round completed normally or gave up
+// early on a client's contribution that never arrived (see the ackTimeout
+// case in collect).
+func (p *pipelineEventCB) finishCollect(signalers []chan struct{}, events, lastEvents []beat.Event, metas []beat.EventMeta, total, acked int) {
 	// signal clients we processed all active ACKs, as reported by broker
 	for _, sig := range signalers {
 		close(sig)
 	}
-	p.reportEvents(events, total)
-	return
-}
 
-func (p *pipelineEventCB) reportEvents(events []beat.Event, total int) {
-	// report ACK back to the beat
-	switch p.mode {
-	case countACKMode:
-		p.handler.ACKCount(total)
-	case eventsACKMode:
-		p.handler.ACKEvents(events)
-	case lastEventsACKMode:
-		p.handler.ACKLastEvents(events)
+	if p.checkpoint != nil {
+		// metas carries every event's Meta, not just the last one: a
+		// single collected batch routinely spans several concurrently
+		// publishing inputs, and each needs its own offset persisted
+		// (see checkpointer.update).
+		if err := p.checkpoint.update(metas); err != nil {
+			logp.Err("failed to persist ACK checkpoint: %v", err)
+		}
 	}
+
+	p.reportEvents(events, lastEvents, metas, total, acked)
+}
+
+// reportEvents fans a collected ACK batch out to every ACKBus subscriber,
+// including the handler passed at construction time (see forwardToHandler).
+// events and lastEvents are nil unless a subscriber's mode required the
+// full batch (see ACKBus.needsEvents); metas always carries every
+// collected event's Meta.
+func (p *pipelineEventCB) reportEvents(events, lastEvents []beat.Event, metas []beat.EventMeta, total, acked int) {
+	p.bus.publish(total, acked, events, lastEvents, metas)
 }
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/publisher/beat"
+)
+
+// TestPipelineEventCBLastEventsPerMessage verifies that ACKLastEvents
+// receives one event per client contribution collected into a broker ACK,
+// not just the single last event of the whole coalesced batch: a collect()
+// round routinely coalesces several concurrently-publishing clients, and
+// each one's own last event must reach the subscriber.
+func TestPipelineEventCBLastEventsPerMessage(t *testing.T) {
+	got := make(chan []beat.Event, 1)
+
+	cb, err := newPipelineEventCB(beat.PipelineACKHandler{
+		ACKLastEvents: func(events []beat.Event) {
+			got <- events
+		},
+	})
+	if err != nil {
+		t.Fatalf("newPipelineEventCB failed: %v", err)
+	}
+	defer cb.close()
+
+	clientA := []beat.Event{
+		{Meta: beat.EventMeta{Source: "a1"}},
+		{Meta: beat.EventMeta{Source: "a2"}},
+	}
+	clientB := []beat.Event{
+		{Meta: beat.EventMeta{Source: "b1"}},
+	}
+
+	go cb.onEvents(context.Background(), clientA, len(clientA))
+	go cb.onEvents(context.Background(), clientB, len(clientB))
+
+	// One broker ACK covering both clients' contributions coalesces them
+	// into a single collect() round.
+	cb.reportBrokerACK(len(clientA) + len(clientB))
+
+	select {
+	case events := <-got:
+		if len(events) != 2 {
+			t.Fatalf("expected one last event per client, got %d: %+v", len(events), events)
+		}
+		sources := map[string]bool{}
+		for _, e := range events {
+			sources[e.Meta.Source] = true
+		}
+		if !sources["a2"] || !sources["b1"] {
+			t.Fatalf("expected last events from both clients (a2, b1), got %+v", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ACKLastEvents was never called")
+	}
+}
+
+// TestPipelineEventCBCollectRecoversFromAbandonedContribution verifies that
+// collect() gives up on a client contribution that never arrives (e.g. a
+// client abandoned onEvents/onCounts after the broker already counted it)
+// instead of hanging forever and wedging every later ACK behind it.
+func TestPipelineEventCBCollectRecoversFromAbandonedContribution(t *testing.T) {
+	counts := make(chan int, 2)
+
+	cb, err := newPipelineEventCBWithConfig(pipelineEventCBConfig{
+		Handler:          beat.PipelineACKHandler{ACKCount: func(n int) { counts <- n }},
+		CheckpointConfig: defaultCheckpointConfig(),
+		BatchConfig:      defaultBatchConfig(),
+		ACKTimeout:       10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("newPipelineEventCBWithConfig failed: %v", err)
+	}
+	defer cb.close()
+
+	// The broker reports 5 acked events, but no client ever delivers an
+	// eventsMsg for them: this simulates every client having abandoned its
+	// send. Without a recovery path, the worker's collect() loop would
+	// block here forever.
+	cb.reportBrokerACK(5)
+
+	select {
+	case n := <-counts:
+		if n != 0 {
+			t.Fatalf("expected the abandoned round to report 0 collected events, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("collect() never gave up on the abandoned contribution")
+	}
+
+	if got := cb.CollectTimeouts(); got == 0 {
+		t.Errorf("expected CollectTimeouts to be incremented, got %d", got)
+	}
+
+	// The worker must have returned to servicing p.acks afterwards, rather
+	// than staying wedged.
+	cb.reportBrokerACK(1)
+	cb.onEvents(context.Background(), make([]beat.Event, 1), 1)
+	select {
+	case n := <-counts:
+		if n != 1 {
+			t.Fatalf("expected the next round to collect 1 event, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not recover after the abandoned round")
+	}
+}
+
+// TestPipelineEventCBShutdownMidACK verifies that onEvents returns instead
+// of blocking forever when the pipeline is closed while a client is
+// waiting for its ACK to be collected, with no ACK timeout configured to
+// fall back on.
+func TestPipelineEventCBShutdownMidACK(t *testing.T) {
+	cb, err := newPipelineEventCB(beat.PipelineACKHandler{
+		ACKCount: func(int) {},
+	})
+	if err != nil {
+		t.Fatalf("newPipelineEventCB failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cb.onEvents(context.Background(), make([]beat.Event, 1), 1)
+		close(done)
+	}()
+
+	// Close the pipeline while the client is still waiting to be collected
+	// by the worker (no broker ACK is ever reported), simulating a
+	// shutdown racing a client ACK report.
+	time.Sleep(10 * time.Millisecond)
+	cb.close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onEvents did not return after pipeline shutdown")
+	}
+
+	if got := cb.ACKTimeouts(); got == 0 {
+		t.Errorf("expected ACKTimeouts to be incremented, got %d", got)
+	}
+}
+
+// TestPipelineEventCBACKTimeout verifies that onEvents gives up after
+// ackTimeout elapses, rather than blocking forever on a stuck worker.
+func TestPipelineEventCBACKTimeout(t *testing.T) {
+	cb, err := newPipelineEventCBWithConfig(pipelineEventCBConfig{
+		Handler:          beat.PipelineACKHandler{ACKCount: func(int) {}},
+		CheckpointConfig: defaultCheckpointConfig(),
+		ACKTimeout:       10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("newPipelineEventCBWithConfig failed: %v", err)
+	}
+	defer cb.close()
+
+	// The worker only drains p.events from inside collect(), which is only
+	// entered once reportBrokerACK is called. Since nothing calls it here,
+	// this onEvents send never finds a receiver and must rely on
+	// ackTimeout to return.
+	done := make(chan struct{})
+	go func() {
+		cb.onEvents(context.Background(), make([]beat.Event, 1), 1)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onEvents did not time out waiting on a stuck worker")
+	}
+
+	if got := cb.ACKTimeouts(); got == 0 {
+		t.Errorf("expected ACKTimeouts to be incremented, got %d", got)
+	}
+}